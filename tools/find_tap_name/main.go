@@ -15,11 +15,17 @@
 package main
 
 import (
+  "encoding/json"
   "flag"
   "fmt"
   "log"
   "os"
+  "strings"
+  "syscall"
+  "time"
+  "unsafe"
 
+  "golang.org/x/sys/windows"
   "golang.org/x/sys/windows/registry"
 )
 
@@ -30,27 +36,224 @@ const (
   netConfigKeyPath = `SYSTEM\CurrentControlSet\Control\Network\{4D36E972-E325-11CE-BFC1-08002BE10318}`
 )
 
-// findNetworkAdapterName searches the Windows registry for the name of a network adapter with
-// `componentID`. Since there may be more than one network adapter with the same component ID,
-// selects the most recently installed device in the event of a conflict.
-// Returns an empty string and an error if the device name cannot be found.
-func findNetworkAdapterName(componentID string) (string, error) {
+const (
+  // Flags for RegNotifyChangeKeyValue; see
+  // https://docs.microsoft.com/en-us/windows/win32/api/winreg/nf-winreg-regnotifychangekeyvalue
+  regNotifyChangeName    = 0x00000001
+  regNotifyChangeLastSet = 0x00000004
+)
+
+var (
+  // modnci wraps nci.dll, which is undocumented but has shipped since Windows XP; it isn't
+  // present on all builds, so callers must check modnci.Load() before using it.
+  modnci                   = syscall.NewLazyDLL("nci.dll")
+  procNciSetConnectionName = modnci.NewProc("NciSetConnectionName")
+
+  modsetupapi                      = syscall.NewLazyDLL("setupapi.dll")
+  procSetupDiGetClassDevsEx        = modsetupapi.NewProc("SetupDiGetClassDevsExW")
+  procSetupDiEnumDeviceInfo        = modsetupapi.NewProc("SetupDiEnumDeviceInfo")
+  procSetupDiOpenDevRegKey         = modsetupapi.NewProc("SetupDiOpenDevRegKey")
+  procSetupDiGetDeviceInstanceId   = modsetupapi.NewProc("SetupDiGetDeviceInstanceIdW")
+  procSetupDiDestroyDeviceInfoList = modsetupapi.NewProc("SetupDiDestroyDeviceInfoList")
+  procSetupDiCallClassInstaller    = modsetupapi.NewProc("SetupDiCallClassInstaller")
+)
+
+const (
+  digcfPresent       = 0x00000002
+  invalidHandleValue = ^uintptr(0)
+  dicsFlagGlobal     = 0x00000001
+  diregDrv           = 0x00000001
+  // difRemove is DIF_REMOVE, the class installer function that uninstalls a device.
+  difRemove = 0x00000005
+)
+
+// guidDevClassNet is GUID_DEVCLASS_NET, the device setup class for network adapters. It's the
+// same class whose registry location is netAdaptersKeyPath/netConfigKeyPath.
+var guidDevClassNet = windows.GUID{
+  Data1: 0x4D36E972,
+  Data2: 0xE325,
+  Data3: 0x11CE,
+  Data4: [8]byte{0xBF, 0xC1, 0x08, 0x00, 0x2B, 0xE1, 0x03, 0x18},
+}
+
+// spDevinfoData mirrors the Win32 SP_DEVINFO_DATA struct.
+type spDevinfoData struct {
+  cbSize    uint32
+  classGUID windows.GUID
+  devInst   uint32
+  reserved  uintptr
+}
+
+// adapterInfo describes a network adapter found in the registry, identified both by its
+// human-readable friendly name and by the stable identifiers (NetCfgInstanceId, LUID) that
+// callers can use to address the interface without depending on localized or duplicate names.
+type adapterInfo struct {
+  Name             string `json:"name"`
+  ComponentID      string `json:"componentId"`
+  NetCfgInstanceID string `json:"netCfgInstanceId"`
+  // LUID is the adapter's NDIS locally unique identifier, packed as described at
+  // https://docs.microsoft.com/en-us/windows-hardware/drivers/ddi/ifdef/ns-ifdef-net_luid_lh.
+  LUID             uint64 `json:"luid"`
+  InstallTimestamp uint64 `json:"installTimestamp"`
+  // DeviceInstanceID is the adapter's PnP device instance ID. Only populated by the "list"
+  // subcommand, since obtaining it requires an extra SetupAPI device enumeration.
+  DeviceInstanceID string `json:"deviceInstanceId,omitempty"`
+}
+
+// packLUID reassembles a NET_LUID from the adapter's NetLuidIndex and *IfType registry values,
+// following the layout of the NET_LUID_LH union (IfType in the high 16 bits, NetLuidIndex in the
+// next 24 bits).
+func packLUID(luidIndex, ifType uint64) uint64 {
+  return ((luidIndex & 0xFFFFFF) << 24) | ((ifType & 0xFFFF) << 48)
+}
+
+// regNotifyChangeKeyValue asks the system to signal `event` once `key` (and, if watchSubtree is
+// true, any of its subkeys) changes in a way matching notifyFilter. The notification fires once;
+// callers that want to keep watching must call this again after the event is signaled.
+func regNotifyChangeKeyValue(key registry.Key, watchSubtree bool, notifyFilter uint32, event windows.Handle) error {
+  return windows.RegNotifyChangeKeyValue(windows.Handle(key), watchSubtree, notifyFilter, event, true)
+}
+
+// waitForRegistryChange blocks until `key` (or one of its subkeys) changes, or until `timeout`
+// elapses, whichever happens first. Returns an error if the timeout is reached first.
+// A non-positive timeout times out immediately instead of blocking: the caller's deadline may
+// already have passed by the time it gets here (e.g. after the registry calls that preceded this
+// one), and a negative duration must never reach WaitForSingleObject, since its conversion to
+// uint32 milliseconds wraps to INFINITE or to a value close to it, blocking (almost) forever.
+func waitForRegistryChange(key registry.Key, timeout time.Duration) error {
+  if timeout <= 0 {
+    return fmt.Errorf("Timed out waiting for the network adapter to appear")
+  }
+
+  event, err := windows.CreateEvent(nil, 0, 0, nil)
+  if err != nil {
+    return fmt.Errorf("Failed to create notification event: %v", err)
+  }
+  defer windows.CloseHandle(event)
+
+  if err := regNotifyChangeKeyValue(key, true, regNotifyChangeName|regNotifyChangeLastSet, event); err != nil {
+    return fmt.Errorf("Failed to register for registry change notifications: %v", err)
+  }
+
+  timeoutMs := uint32(timeout.Nanoseconds() / int64(time.Millisecond))
+  switch s, err := windows.WaitForSingleObject(event, timeoutMs); {
+  case err != nil:
+    return fmt.Errorf("Failed to wait for registry change: %v", err)
+  case s == uint32(windows.WAIT_TIMEOUT):
+    return fmt.Errorf("Timed out waiting for the network adapter to appear")
+  }
+  return nil
+}
+
+// findNetworkAdapter searches the Windows registry for a network adapter whose ComponentId is in
+// `componentIDs`. Since there may be more than one matching network adapter, selects the most
+// recently installed device in the event of a conflict.
+// If the adapter is not found and `wait` is greater than zero, blocks until a matching adapter is
+// installed or `wait` elapses, whichever happens first, instead of failing immediately. This
+// accommodates callers (e.g. Outline's Windows installer) that run immediately after
+// tapinstall.exe, before the registry has fully materialized the new adapter.
+// Returns nil and an error if the device cannot be found.
+func findNetworkAdapter(componentIDs []string, wait time.Duration) (*adapterInfo, error) {
+  deadline := time.Now().Add(wait)
+  for {
+    info, err := scanForNetworkAdapter(componentIDs, deadline)
+    if err == nil {
+      return info, nil
+    }
+    if wait <= 0 || !time.Now().Before(deadline) {
+      return nil, err
+    }
+
+    netAdaptersKey, openErr := registry.OpenKey(
+      registry.LOCAL_MACHINE, netAdaptersKeyPath, registry.NOTIFY|registry.READ)
+    if openErr != nil {
+      return nil, fmt.Errorf("Failed to open the network adapter registry, %v", openErr)
+    }
+    waitErr := waitForRegistryChange(netAdaptersKey, time.Until(deadline))
+    netAdaptersKey.Close()
+    if waitErr != nil {
+      return nil, waitErr
+    }
+  }
+}
+
+// scanForNetworkAdapter performs a single pass over the registry looking for `componentIDs`. If
+// none of them has a readable name yet, waits (bounded by `deadline`) on the single most
+// recently installed candidate's network configuration key before giving up, since Windows
+// populates NetCfgInstanceId slightly before Connection\Name. That wait is deliberately scoped to
+// one candidate: gating it on every candidate in turn would let one broken, unresponsive adapter
+// starve out discovery of another adapter that's actually ready.
+func scanForNetworkAdapter(componentIDs []string, deadline time.Time) (*adapterInfo, error) {
+  matches, pending, err := scanAllNetworkAdapters(componentIDs)
+  if err != nil {
+    return nil, err
+  }
+
+  if len(matches) == 0 && len(pending) > 0 && time.Now().Before(deadline) {
+    best := pending[0]
+    for _, p := range pending[1:] {
+      if p.installTimestamp > best.installTimestamp {
+        best = p
+      }
+    }
+    if name, err := readAdapterConnectionName(best.configKeyPath, deadline); err == nil {
+      matches = append(matches, adapterInfo{
+        Name:             name,
+        ComponentID:      best.componentID,
+        NetCfgInstanceID: best.netCfgInstanceID,
+        LUID:             packLUID(best.luidIndex, best.ifType),
+        InstallTimestamp: best.installTimestamp,
+      })
+    }
+  }
+
+  // Keep track of the most recently installed matching adapter.
+  var info *adapterInfo
+  for i := range matches {
+    if info == nil || matches[i].InstallTimestamp > info.InstallTimestamp {
+      info = &matches[i]
+    }
+  }
+  if info == nil {
+    return nil, fmt.Errorf("Could not find the network adapter with the specified component ID")
+  }
+  return info, nil
+}
+
+// pendingAdapter is a matched adapter whose Connection\Name wasn't immediately readable, along
+// with what's needed to read or wait for it later.
+type pendingAdapter struct {
+  componentID      string
+  netCfgInstanceID string
+  installTimestamp uint64
+  luidIndex        uint64
+  ifType           uint64
+  configKeyPath    string
+}
+
+// scanAllNetworkAdapters performs a single, non-blocking pass over the registry, returning every
+// installed adapter whose ComponentId is in `componentIDs` and whose name could be read
+// immediately, plus any matching adapter whose name wasn't ready yet as a pendingAdapter. Unlike
+// scanForNetworkAdapter, this never blocks on a single candidate: that's left to the caller, so
+// that enumerating the rest of the registry is never gated on one unresponsive adapter. Used
+// directly for diagnostics, where ghost or orphaned adapters left behind by failed installs are
+// exactly the state that needs to be visible. A matching adapter whose install timestamp,
+// NetCfgInstanceId, NetLuidIndex or *IfType can't be read is skipped and appears in neither list.
+func scanAllNetworkAdapters(componentIDs []string) ([]adapterInfo, []pendingAdapter, error) {
   netAdaptersKey, err := registry.OpenKey(registry.LOCAL_MACHINE, netAdaptersKeyPath, registry.READ)
   if err != nil {
-    return "", fmt.Errorf("Failed to open the network adapter registry, %v", err)
+    return nil, nil, fmt.Errorf("Failed to open the network adapter registry, %v", err)
   }
   defer netAdaptersKey.Close()
 
   // List all network adapters.
   adapterKeys, err := netAdaptersKey.ReadSubKeyNames(-1)
   if err != nil {
-    return "", err
+    return nil, nil, err
   }
 
-  // Keep track of the most recently installed adapter name.
-  var name string
-  var installTimestamp uint64
-
+  var matches []adapterInfo
+  var pending []pendingAdapter
   for _, k := range adapterKeys {
     adapterKey, err := registry.OpenKey(registry.LOCAL_MACHINE, netAdaptersKeyPath + "\\" + k, registry.READ)
     if err != nil {
@@ -63,7 +266,7 @@ func findNetworkAdapterName(componentID string) (string, error) {
       continue
     }
     log.Println("Found", adapterComponentID)
-    if adapterComponentID != componentID {
+    if !containsString(componentIDs, adapterComponentID) {
       continue
     }
 
@@ -79,47 +282,493 @@ func findNetworkAdapterName(componentID string) (string, error) {
       log.Println("Failed to read network configuration ID:", err)
       continue
     }
-    adapterConfigKeyPath := fmt.Sprintf("%s\\%s\\Connection", netConfigKeyPath, adapterNetConfigID)
-    adapterConfigKey, err := registry.OpenKey(registry.LOCAL_MACHINE, adapterConfigKeyPath, registry.READ)
+
+    luidIndex, _, err := adapterKey.GetIntegerValue("NetLuidIndex")
+    if err != nil {
+      log.Println("Failed to read adapter LUID index:", err)
+      continue
+    }
+    ifType, _, err := adapterKey.GetIntegerValue("*IfType")
     if err != nil {
-      log.Println("Failed to open network configuration key:", err)
+      log.Println("Failed to read adapter interface type:", err)
       continue
     }
-    defer adapterConfigKey.Close()
 
-    adapterName, _, err := adapterConfigKey.GetStringValue("Name")
+    adapterConfigKeyPath := fmt.Sprintf("%s\\%s", netConfigKeyPath, adapterNetConfigID)
+    adapterName, err := readAdapterConnectionName(adapterConfigKeyPath, time.Now())
     if err != nil {
-      log.Println("Failed to read adapter name:", err)
+      log.Println("Name not yet readable, deferring:", err)
+      pending = append(pending, pendingAdapter{
+        componentID:      adapterComponentID,
+        netCfgInstanceID: adapterNetConfigID,
+        installTimestamp: adapterInstallTimestamp,
+        luidIndex:        luidIndex,
+        ifType:           ifType,
+        configKeyPath:    adapterConfigKeyPath,
+      })
       continue
     }
     log.Println("\tName", adapterName)
 
-    if adapterInstallTimestamp > installTimestamp {
-      // Found a newer device.
-      installTimestamp = adapterInstallTimestamp
-      name = adapterName
+    matches = append(matches, adapterInfo{
+      Name:             adapterName,
+      ComponentID:      adapterComponentID,
+      NetCfgInstanceID: adapterNetConfigID,
+      LUID:             packLUID(luidIndex, ifType),
+      InstallTimestamp: adapterInstallTimestamp,
+    })
+  }
+  return matches, pending, nil
+}
+
+// containsString reports whether `s` is present in `values`.
+func containsString(values []string, s string) bool {
+  for _, v := range values {
+    if v == s {
+      return true
     }
   }
+  return false
+}
+
+// readAdapterConnectionName reads the Connection\Name value under `adapterConfigKeyPath`, waiting
+// (bounded by `deadline`) for it to appear if it has not been written yet.
+func readAdapterConnectionName(adapterConfigKeyPath string, deadline time.Time) (string, error) {
+  connectionKeyPath := adapterConfigKeyPath + `\Connection`
+  for {
+    connectionKey, err := registry.OpenKey(registry.LOCAL_MACHINE, connectionKeyPath, registry.NOTIFY|registry.READ)
+    if err != nil {
+      if !time.Now().Before(deadline) {
+        return "", fmt.Errorf("Failed to open network configuration key: %v", err)
+      }
+      // The adapter's NetCfgInstanceId has appeared, but its Connection subkey has not been
+      // created yet. Wait on the parent key, since the subkey doesn't exist to watch yet.
+      adapterConfigKey, openErr := registry.OpenKey(
+        registry.LOCAL_MACHINE, adapterConfigKeyPath, registry.NOTIFY|registry.READ)
+      if openErr != nil {
+        return "", fmt.Errorf("Failed to open network configuration key: %v", openErr)
+      }
+      waitErr := waitForRegistryChange(adapterConfigKey, time.Until(deadline))
+      adapterConfigKey.Close()
+      if waitErr != nil {
+        return "", waitErr
+      }
+      continue
+    }
 
-  if name == "" {
-    err = fmt.Errorf("Could not find the network adapter with the specified component ID")
+    name, _, err := connectionKey.GetStringValue("Name")
+    if err == nil {
+      connectionKey.Close()
+      return name, nil
+    }
+    if !time.Now().Before(deadline) {
+      connectionKey.Close()
+      return "", fmt.Errorf("Failed to read adapter name: %v", err)
+    }
+    waitErr := waitForRegistryChange(connectionKey, time.Until(deadline))
+    connectionKey.Close()
+    if waitErr != nil {
+      return "", waitErr
+    }
   }
-  return name, err
 }
 
+// renameNetworkAdapter sets a stable, predictable friendly name on the network adapter identified
+// by netCfgInstanceID, via nci.dll's NciSetConnectionName. This avoids depending on whatever
+// localized default Windows assigned (e.g. "Ethernet 3", "Local Area Connection 5"), which breaks
+// netsh calls elsewhere in the Outline client and confuses users who see multiple
+// identical-looking adapters.
+func renameNetworkAdapter(netCfgInstanceID, newName string) error {
+  if err := modnci.Load(); err != nil {
+    return fmt.Errorf("nci.dll is not available on this system: %v", err)
+  }
+  if err := procNciSetConnectionName.Find(); err != nil {
+    return fmt.Errorf("NciSetConnectionName is not available on this system: %v", err)
+  }
 
-func main() {
-  componentID := flag.String("componentid", "tap0901", "Hardware component ID of the network adapter")
-  flag.Parse()
+  inUse, err := isAdapterNameInUse(newName, netCfgInstanceID)
+  if err != nil {
+    return fmt.Errorf("Failed to check for adapter name conflicts: %v", err)
+  }
+  if inUse {
+    return fmt.Errorf("Adapter name %q is already in use by another adapter", newName)
+  }
 
-  // Remove timestamps, output to stderr by default.
-  log.SetFlags(0)
+  guid, err := windows.GUIDFromString(netCfgInstanceID)
+  if err != nil {
+    return fmt.Errorf("Invalid NetCfgInstanceId %q: %v", netCfgInstanceID, err)
+  }
+  namePtr, err := syscall.UTF16PtrFromString(newName)
+  if err != nil {
+    return fmt.Errorf("Invalid adapter name %q: %v", newName, err)
+  }
+
+  if hresult, _, _ := procNciSetConnectionName.Call(
+    uintptr(unsafe.Pointer(&guid)), uintptr(unsafe.Pointer(namePtr))); hresult != 0 {
+    return fmt.Errorf("NciSetConnectionName failed with HRESULT 0x%X", hresult)
+  }
+  return nil
+}
+
+// isAdapterNameInUse reports whether any installed network adapter other than the one identified
+// by excludeID already has `name` as its Connection\Name.
+func isAdapterNameInUse(name, excludeID string) (bool, error) {
+  netConfigKey, err := registry.OpenKey(registry.LOCAL_MACHINE, netConfigKeyPath, registry.READ)
+  if err != nil {
+    return false, fmt.Errorf("Failed to open the network configuration registry, %v", err)
+  }
+  defer netConfigKey.Close()
 
-  name, err := findNetworkAdapterName(*componentID)
+  adapterIDs, err := netConfigKey.ReadSubKeyNames(-1)
+  if err != nil {
+    return false, err
+  }
+  for _, id := range adapterIDs {
+    if strings.EqualFold(id, excludeID) {
+      continue
+    }
+    connectionKeyPath := fmt.Sprintf("%s\\%s\\Connection", netConfigKeyPath, id)
+    connectionKey, err := registry.OpenKey(registry.LOCAL_MACHINE, connectionKeyPath, registry.READ)
+    if err != nil {
+      continue
+    }
+    existingName, _, err := connectionKey.GetStringValue("Name")
+    connectionKey.Close()
+    if err == nil && existingName == name {
+      return true, nil
+    }
+  }
+  return false, nil
+}
+
+// deviceInstanceID returns the PnP device instance ID of the network adapter whose driver
+// registry key has NetCfgInstanceId equal to netCfgInstanceID, via SetupAPI. This identifier
+// isn't otherwise exposed through the registry keys used elsewhere in this file.
+func deviceInstanceID(netCfgInstanceID string) (string, error) {
+  devs, _, err := procSetupDiGetClassDevsEx.Call(
+    uintptr(unsafe.Pointer(&guidDevClassNet)), 0, 0, digcfPresent, 0, 0, 0)
+  if devs == invalidHandleValue {
+    return "", fmt.Errorf("SetupDiGetClassDevsEx failed: %v", err)
+  }
+  defer procSetupDiDestroyDeviceInfoList.Call(devs)
+
+  var data spDevinfoData
+  data.cbSize = uint32(unsafe.Sizeof(data))
+  for i := uint32(0); ; i++ {
+    r, _, enumErr := procSetupDiEnumDeviceInfo.Call(devs, uintptr(i), uintptr(unsafe.Pointer(&data)))
+    if r == 0 {
+      if enumErr == windows.ERROR_NO_MORE_ITEMS {
+        break
+      }
+      return "", fmt.Errorf("SetupDiEnumDeviceInfo failed: %v", enumErr)
+    }
+
+    hkey, _, regErr := procSetupDiOpenDevRegKey.Call(
+      devs, uintptr(unsafe.Pointer(&data)), dicsFlagGlobal, 0, diregDrv, uintptr(registry.READ))
+    if hkey == 0 || hkey == invalidHandleValue {
+      log.Println("Failed to open device driver registry key:", regErr)
+      continue
+    }
+    driverKey := registry.Key(hkey)
+    driverNetConfigID, _, err := driverKey.GetStringValue("NetCfgInstanceId")
+    driverKey.Close()
+    if err != nil || driverNetConfigID != netCfgInstanceID {
+      continue
+    }
+
+    var required uint32
+    procSetupDiGetDeviceInstanceId.Call(
+      devs, uintptr(unsafe.Pointer(&data)), 0, 0, uintptr(unsafe.Pointer(&required)))
+    buf := make([]uint16, required)
+    r, _, idErr := procSetupDiGetDeviceInstanceId.Call(
+      devs, uintptr(unsafe.Pointer(&data)), uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)),
+      uintptr(unsafe.Pointer(&required)))
+    if r == 0 {
+      return "", fmt.Errorf("SetupDiGetDeviceInstanceId failed: %v", idErr)
+    }
+    return syscall.UTF16ToString(buf), nil
+  }
+  return "", fmt.Errorf("No PnP device found for NetCfgInstanceId %s", netCfgInstanceID)
+}
+
+// isAdapterDisconnected reports whether the network adapter identified by netCfgInstanceID is
+// flagged as media-disconnected, via the Connection\MediaState value Windows writes for an
+// adapter that has no link (the value is only present while disconnected; its absence means
+// connected).
+func isAdapterDisconnected(netCfgInstanceID string) bool {
+  connectionKeyPath := fmt.Sprintf("%s\\%s\\Connection", netConfigKeyPath, netCfgInstanceID)
+  connectionKey, err := registry.OpenKey(registry.LOCAL_MACHINE, connectionKeyPath, registry.READ)
+  if err != nil {
+    return false
+  }
+  defer connectionKey.Close()
+
+  mediaState, _, err := connectionKey.GetIntegerValue("MediaState")
+  return err == nil && mediaState != 0
+}
+
+// removeStaleAdapters enumerates every present network adapter whose ComponentId is in
+// `componentIDs` and, per componentID, removes every instance of it except the most recently
+// installed one that is both connected and has a valid NetCfgInstanceId, via
+// SetupDiCallClassInstaller(DIF_REMOVE, ...). This is computed independently per componentID so
+// that, e.g., a single "tap0901,Wintun" invocation keeps one working instance of each rather than
+// treating whichever type is older as entirely stale. Upgrading Outline across many versions
+// accumulates ghost TAP adapters that break findNetworkAdapter's "pick the newest" heuristic when
+// the newest one is actually broken; this lets installs reliably converge on a single working
+// adapter per type. An instance whose install timestamp can't be read is left in place and is not
+// counted. If dryRun is true, only logs what would be removed.
+// Returns the number of adapters removed (or, in dry-run mode, that would be removed).
+func removeStaleAdapters(componentIDs []string, dryRun bool) (int, error) {
+  devs, _, err := procSetupDiGetClassDevsEx.Call(
+    uintptr(unsafe.Pointer(&guidDevClassNet)), 0, 0, digcfPresent, 0, 0, 0)
+  if devs == invalidHandleValue {
+    return 0, fmt.Errorf("SetupDiGetClassDevsEx failed: %v", err)
+  }
+  defer procSetupDiDestroyDeviceInfoList.Call(devs)
+
+  type candidate struct {
+    data             spDevinfoData
+    componentID      string
+    netCfgInstanceID string
+    installTimestamp uint64
+    valid            bool
+    disconnected     bool
+  }
+  var candidates []candidate
+  for i := uint32(0); ; i++ {
+    var data spDevinfoData
+    data.cbSize = uint32(unsafe.Sizeof(data))
+    r, _, enumErr := procSetupDiEnumDeviceInfo.Call(devs, uintptr(i), uintptr(unsafe.Pointer(&data)))
+    if r == 0 {
+      if enumErr == windows.ERROR_NO_MORE_ITEMS {
+        break
+      }
+      return 0, fmt.Errorf("SetupDiEnumDeviceInfo failed: %v", enumErr)
+    }
+
+    hkey, _, regErr := procSetupDiOpenDevRegKey.Call(
+      devs, uintptr(unsafe.Pointer(&data)), dicsFlagGlobal, 0, diregDrv, uintptr(registry.READ))
+    if hkey == 0 || hkey == invalidHandleValue {
+      log.Println("Failed to open device driver registry key:", regErr)
+      continue
+    }
+    driverKey := registry.Key(hkey)
+    driverComponentID, _, err := driverKey.GetStringValue("ComponentId")
+    if err != nil || !containsString(componentIDs, driverComponentID) {
+      driverKey.Close()
+      continue
+    }
+    driverNetConfigID, _, netErr := driverKey.GetStringValue("NetCfgInstanceId")
+    installTimestamp, _, tsErr := driverKey.GetIntegerValue("NetworkInterfaceInstallTimestamp")
+    driverKey.Close()
+    if tsErr != nil {
+      // Can't tell how old this adapter is yet (e.g. an install still in progress), so don't
+      // risk removing it in place of a genuinely stale one.
+      log.Println("Failed to read adapter install timestamp, skipping:", tsErr)
+      continue
+    }
+
+    valid := netErr == nil && driverNetConfigID != ""
+    candidates = append(candidates, candidate{
+      data:             data,
+      componentID:      driverComponentID,
+      netCfgInstanceID: driverNetConfigID,
+      installTimestamp: installTimestamp,
+      valid:            valid,
+      disconnected:     valid && isAdapterDisconnected(driverNetConfigID),
+    })
+  }
+
+  // Per componentID, keep the most recently installed adapter that's valid and connected; every
+  // other instance of that componentID -- including one that's merely older, disconnected, or
+  // has no valid NetCfgInstanceId -- is a ghost left behind by a failed or superseded install.
+  keep := make(map[string]int)
+  for i, c := range candidates {
+    if !c.valid || c.disconnected {
+      continue
+    }
+    if cur, ok := keep[c.componentID]; !ok || c.installTimestamp > candidates[cur].installTimestamp {
+      keep[c.componentID] = i
+    }
+  }
+
+  removed := 0
+  for i, c := range candidates {
+    if cur, ok := keep[c.componentID]; ok && cur == i {
+      continue
+    }
+    if dryRun {
+      log.Printf("Would remove stale adapter componentId=%s netCfgInstanceId=%s installTimestamp=%d disconnected=%v",
+        c.componentID, c.netCfgInstanceID, c.installTimestamp, c.disconnected)
+      removed++
+      continue
+    }
+    if r, _, remErr := procSetupDiCallClassInstaller.Call(
+      difRemove, devs, uintptr(unsafe.Pointer(&c.data))); r == 0 {
+      log.Printf("Failed to remove adapter componentId=%s netCfgInstanceId=%s: %v",
+        c.componentID, c.netCfgInstanceID, remErr)
+      continue
+    }
+    log.Printf("Removed stale adapter componentId=%s netCfgInstanceId=%s installTimestamp=%d disconnected=%v",
+      c.componentID, c.netCfgInstanceID, c.installTimestamp, c.disconnected)
+    removed++
+  }
+  return removed, nil
+}
+
+// parseComponentIDs splits a comma-separated -componentid flag value (e.g.
+// "tap0901,Wintun,root\\tap0901") into its constituent hardware IDs, trimming whitespace around
+// each one.
+func parseComponentIDs(s string) []string {
+  var ids []string
+  for _, id := range strings.Split(s, ",") {
+    if id = strings.TrimSpace(id); id != "" {
+      ids = append(ids, id)
+    }
+  }
+  return ids
+}
+
+// runFindCommand is the default command: find a network adapter matching -componentid and print
+// its name (or, with -format json, its full adapter details) to stdout.
+func runFindCommand(args []string) {
+  fs := flag.NewFlagSet("find", flag.ExitOnError)
+  componentID := fs.String("componentid", "tap0901", "Comma-separated hardware component IDs of the network adapter")
+  wait := fs.Duration(
+    "wait", 0, "Block until a matching network adapter appears, up to this duration (e.g. 30s)")
+  format := fs.String("format", "name", "Output format: \"name\" for the friendly name, or \"json\" for full adapter details")
+  fs.Parse(args)
+
+  info, err := findNetworkAdapter(parseComponentIDs(*componentID), *wait)
+  if err != nil {
+    log.Fatalf(err.Error())
+  }
+  // Output the result to stdout.
+  log.SetOutput(os.Stdout)
+  switch *format {
+  case "json":
+    out, err := json.Marshal(info)
+    if err != nil {
+      log.SetOutput(os.Stderr)
+      log.Fatalf("Failed to marshal adapter info: %v", err)
+    }
+    log.Print(string(out))
+  default:
+    log.Print(info.Name)
+  }
+}
+
+// runRenameCommand is the "rename" subcommand: find a network adapter matching -componentid and
+// give it a stable friendly name, via -to, that doesn't depend on Windows' localized default.
+func runRenameCommand(args []string) {
+  fs := flag.NewFlagSet("rename", flag.ExitOnError)
+  componentID := fs.String("componentid", "tap0901", "Comma-separated hardware component IDs of the network adapter to rename")
+  newName := fs.String("to", "", "New friendly name for the adapter")
+  wait := fs.Duration(
+    "wait", 0, "Block until a matching network adapter appears, up to this duration (e.g. 30s)")
+  fs.Parse(args)
+  if *newName == "" {
+    log.Fatalf("-to is required")
+  }
+
+  info, err := findNetworkAdapter(parseComponentIDs(*componentID), *wait)
+  if err != nil {
+    log.Fatalf(err.Error())
+  }
+  if err := renameNetworkAdapter(info.NetCfgInstanceID, *newName); err != nil {
+    log.Fatalf("Failed to rename adapter: %v", err)
+  }
+
+  log.SetOutput(os.Stdout)
+  log.Print(*newName)
+}
+
+// runListCommand is the "list" subcommand: print every installed adapter matching -componentid,
+// not just the most recently installed one, so support engineers can see leftover or orphaned
+// adapters from failed installs that findNetworkAdapter's "pick the newest" heuristic hides.
+// Adapters that scanAllNetworkAdapters skips are not listed.
+func runListCommand(args []string) {
+  fs := flag.NewFlagSet("list", flag.ExitOnError)
+  componentID := fs.String("componentid", "tap0901", "Comma-separated hardware component IDs of the network adapters to list")
+  format := fs.String("format", "name", "Output format: \"name\" for a human-readable table, or \"json\" for full adapter details")
+  fs.Parse(args)
+
+  matches, pending, err := scanAllNetworkAdapters(parseComponentIDs(*componentID))
   if err != nil {
     log.Fatalf(err.Error())
   }
-  // Output the name to stdout.
+  // Adapters whose name wasn't immediately readable are still installed and still worth
+  // surfacing for diagnostics; list them too, just without a friendly name.
+  for _, p := range pending {
+    matches = append(matches, adapterInfo{
+      ComponentID:      p.componentID,
+      NetCfgInstanceID: p.netCfgInstanceID,
+      LUID:             packLUID(p.luidIndex, p.ifType),
+      InstallTimestamp: p.installTimestamp,
+    })
+  }
+  for i := range matches {
+    id, err := deviceInstanceID(matches[i].NetCfgInstanceID)
+    if err != nil {
+      log.Println("Failed to find PnP device instance ID:", err)
+      continue
+    }
+    matches[i].DeviceInstanceID = id
+  }
+
+  log.SetOutput(os.Stdout)
+  switch *format {
+  case "json":
+    out, err := json.Marshal(matches)
+    if err != nil {
+      log.SetOutput(os.Stderr)
+      log.Fatalf("Failed to marshal adapter info: %v", err)
+    }
+    log.Print(string(out))
+  default:
+    for _, m := range matches {
+      log.Printf("%s\tcomponentId=%s\tnetCfgInstanceId=%s\tluid=%d\tinstallTimestamp=%d\tdeviceInstanceId=%s",
+        m.Name, m.ComponentID, m.NetCfgInstanceID, m.LUID, m.InstallTimestamp, m.DeviceInstanceID)
+    }
+  }
+}
+
+// runRemoveStaleCommand is the "remove-stale" subcommand: for each ID in -componentid, uninstall
+// every matching adapter except the most recently installed one that is connected and has a valid
+// NetCfgInstanceId, via SetupAPI (see removeStaleAdapters).
+func runRemoveStaleCommand(args []string) {
+  fs := flag.NewFlagSet("remove-stale", flag.ExitOnError)
+  componentID := fs.String("componentid", "tap0901", "Comma-separated hardware component IDs of the network adapters to clean up")
+  dryRun := fs.Bool("dry-run", false, "Log what would be removed, without actually removing anything")
+  fs.Parse(args)
+
   log.SetOutput(os.Stdout)
-  log.Print(name)
+  removed, err := removeStaleAdapters(parseComponentIDs(*componentID), *dryRun)
+  if err != nil {
+    log.SetOutput(os.Stderr)
+    log.Fatalf(err.Error())
+  }
+  if removed == 0 {
+    log.Print("No stale network adapters removed")
+  }
+}
+
+func main() {
+  // Remove timestamps, output to stderr by default.
+  log.SetFlags(0)
+
+  if len(os.Args) > 1 {
+    switch os.Args[1] {
+    case "rename":
+      runRenameCommand(os.Args[2:])
+      return
+    case "list":
+      runListCommand(os.Args[2:])
+      return
+    case "remove-stale":
+      runRemoveStaleCommand(os.Args[2:])
+      return
+    }
+  }
+  runFindCommand(os.Args[1:])
 }